@@ -2,19 +2,34 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"encoding/json"
+	stderrors "errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
 	"os"
 	"os/exec"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"regexp"
+	"runtime"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/pkg/errors"
+	"github.com/pkg/sftp"
 	"github.com/urfave/cli"
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"golang.org/x/crypto/ssh/terminal"
+	"gopkg.in/yaml.v2"
 )
 
 // Description is the long-form explanation of how to use the program.
@@ -26,10 +41,10 @@ additional thread-based (not process-based) ssh functionality.
 
 You can pass two formats to each command:
 
-%t - the thread id (unique id of each thread)
+%t - the worker id (unique id of each pool worker, not the item position)
 %i - the item if -i was enabled, this will be a unique line from stdin.
 
-No attempt is made to guarantee thread/item uniformity; runs may change thread
+No attempt is made to guarantee worker/item uniformity; runs may change worker
 ids for items between invocations.
 
 If both count and input are specified, the longer length wins, with the input
@@ -39,8 +54,10 @@ count.
 If count is specified in ssh mode, it will be multiplied by the host list; and
 count invocations will be run on each host.
 
-There is currently no concurrency limit; it's gated at the number of items you
-pass it.
+Work is dispatched across a bounded pool of workers, sized with --jobs, -j.
+With --stream, -i reads stdin line-by-line and dispatches to idle workers as
+lines arrive instead of reading the whole input up front, so an unbounded
+pipe can be processed without buffering it in memory.
 `
 
 const (
@@ -62,6 +79,68 @@ var commonFlags = []cli.Flag{
 		Usage: "Perform count number of items; if supplied with -i, will use the largest value",
 		Value: 1,
 	},
+	cli.BoolFlag{
+		Name:  "stream",
+		Usage: "With -i, dispatch stdin to workers line-by-line as it is read instead of reading it all in first; required for unbounded pipes",
+	},
+}
+
+// sshConnFlags are the flags shared by every subcommand that dials out over
+// SSH (ssh, ssh-script, push and pull).
+var sshConnFlags = []cli.Flag{
+	cli.DurationFlag{
+		Name:  "timeout, t",
+		Usage: "Timeout for SSH connections",
+		Value: time.Minute,
+	},
+	cli.StringFlag{
+		Name:  "username, u",
+		Usage: "Username to connect as",
+		Value: os.Getenv("USER"),
+	},
+	cli.StringFlag{
+		Name:  "password, p",
+		Usage: "password to connect with, if any",
+	},
+	cli.StringFlag{
+		Name:  "identity, d",
+		Usage: "identity file to connect with",
+	},
+	cli.BoolFlag{
+		Name:  "no-agent, n",
+		Usage: "Do not attempt to use a ssh-agent",
+	},
+	cli.BoolFlag{
+		Name:  "no-prefix, r",
+		Usage: "Do not prefix output with IP information",
+	},
+	cli.StringFlag{
+		Name:  "known-hosts, k",
+		Usage: "Path to an OpenSSH-style known_hosts file used for host key verification",
+		Value: defaultKnownHostsPath(),
+	},
+	cli.BoolFlag{
+		Name:  "insecure",
+		Usage: "Do not verify host keys (equivalent to the old, always-on behavior)",
+	},
+	cli.BoolFlag{
+		Name:  "tofu",
+		Usage: "Trust-on-first-use: append unknown host keys to the known_hosts file instead of rejecting them",
+	},
+	cli.UintFlag{
+		Name:  "jobs, j",
+		Usage: "Number of worker goroutines dialing and running commands concurrently",
+		Value: 32,
+	},
+	cli.UintFlag{
+		Name:  "retries",
+		Usage: "Number of times to retry a transient SSH dial failure before giving up on that connection",
+	},
+	cli.DurationFlag{
+		Name:  "retry-delay",
+		Usage: "Delay between SSH dial retries",
+		Value: time.Second,
+	},
 }
 
 func main() {
@@ -79,34 +158,38 @@ func main() {
 			ArgsUsage: "-- [ host list file ] [ command ]",
 			Usage:     "Execute a command in parallel over ssh; the host list file is a newline-delimited list of host:port pairs (22 is default)",
 			Action:    sshCommand,
-			Flags: append([]cli.Flag{
-				cli.DurationFlag{
-					Name:  "timeout, t",
-					Usage: "Timeout for SSH connections",
-					Value: time.Minute,
-				},
-				cli.StringFlag{
-					Name:  "username, u",
-					Usage: "Username to connect as",
-					Value: os.Getenv("USER"),
-				},
+			Flags: append(append([]cli.Flag{
 				cli.StringFlag{
-					Name:  "password, p",
-					Usage: "password to connect with, if any",
+					Name:  "output, o",
+					Usage: "Output mode: text (default), or json/ndjson for a machine-readable NDJSON stream of per-line and per-session records",
+					Value: "text",
 				},
-				cli.StringFlag{
-					Name:  "identity, d",
-					Usage: "identity file to connect with",
+				cli.BoolFlag{
+					Name:  "tty, T",
+					Usage: "Allocate a remote pty and propagate local terminal size changes, for programs that require a controlling terminal (sudo, top, curses installers)",
 				},
 				cli.BoolFlag{
-					Name:  "no-agent, n",
-					Usage: "Do not attempt to use a ssh-agent",
+					Name:  "sudo",
+					Usage: "With --tty, pipe the --password value to the remote command's stdin after pty allocation",
+				},
+			}, sshConnFlags...), commonFlags...),
+		},
+		cli.Command{
+			Name:      "ssh-script",
+			ArgsUsage: "-- [ host list file ] [ script file ]",
+			Usage:     "Drive a multi-step interactive SSH session (sudo su, password prompts, setup wizards) from a YAML/JSON send/expect script, across a whole fleet in parallel",
+			Action:    sshScriptCommand,
+			Flags: append([]cli.Flag{
+				cli.UintFlag{
+					Name:  "count, c",
+					Usage: "Number of times to run the script against each host",
+					Value: 1,
 				},
 				cli.BoolFlag{
-					Name:  "no-prefix, r",
-					Usage: "Do not prefix output with IP information",
+					Name:  "quiet, q",
+					Usage: "Do not display shell output from the session",
 				},
-			}, commonFlags...),
+			}, sshConnFlags...),
 		},
 		cli.Command{
 			Name:      "exec",
@@ -114,16 +197,138 @@ func main() {
 			Usage:     "Execute a local command in parallel",
 			ArgsUsage: "-- [ command ]",
 			Action:    execCommand,
-			Flags:     commonFlags,
+			Flags: append([]cli.Flag{
+				cli.UintFlag{
+					Name:  "jobs, j",
+					Usage: "Number of worker goroutines running commands concurrently",
+					Value: uint(runtime.NumCPU()),
+				},
+			}, commonFlags...),
+		},
+		cli.Command{
+			Name:      "push",
+			ArgsUsage: "-- [ host list file ] [ local path ] [ remote path ]",
+			Usage:     "Copy a local file or directory to every host in parallel over SFTP",
+			Action:    pushCommand,
+			Flags:     append([]cli.Flag{}, sshConnFlags...),
+		},
+		cli.Command{
+			Name:      "pull",
+			ArgsUsage: "-- [ host list file ] [ remote path ] [ local dir ]",
+			Usage:     "Copy a remote file or directory from every host in parallel over SFTP, into <local dir>/<host>/...",
+			Action:    pullCommand,
+			Flags:     append([]cli.Flag{}, sshConnFlags...),
 		},
 	}
 
 	if err := app.Run(os.Args); err != nil {
+		if exitErr, ok := err.(cli.ExitCoder); ok {
+			fmt.Fprintf(os.Stderr, err.Error()+"\n")
+			os.Exit(exitErr.ExitCode())
+		}
+
 		fmt.Fprintf(os.Stderr, errors.Wrap(err, "runtime error (try --help)").Error()+"\n")
 		os.Exit(1)
 	}
 }
 
+func defaultKnownHostsPath() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+
+	return filepath.Join(home, ".ssh", "known_hosts")
+}
+
+var (
+	knownHostsMu sync.Mutex
+	tofuSeen     = map[string]ssh.PublicKey{}
+)
+
+// appendKnownHost records hostname/key in the known_hosts file at path. It
+// guards against duplicate entries when multiple goroutines TOFU the same
+// host concurrently, and treats a second, different key offered for a host
+// already TOFU'd this run as a hard mismatch rather than silently trusting
+// it too.
+func appendKnownHost(path, hostname string, key ssh.PublicKey) error {
+	knownHostsMu.Lock()
+	defer knownHostsMu.Unlock()
+
+	if prior, ok := tofuSeen[hostname]; ok {
+		if !bytes.Equal(prior.Marshal(), key.Marshal()) {
+			return errors.Errorf("ssh: host key mismatch for %s: a different key was already trusted for this host during this run", hostname)
+		}
+		return nil
+	}
+
+	line := knownhosts.Line([]string{hostname}, key)
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return errors.Wrap(err, "opening known_hosts for append")
+	}
+	defer f.Close()
+
+	if _, err := fmt.Fprintln(f, line); err != nil {
+		return errors.Wrap(err, "writing known_hosts entry")
+	}
+
+	tofuSeen[hostname] = key
+	return nil
+}
+
+// tofuCallback wraps a known_hosts callback so that unknown hosts are
+// trusted and appended rather than rejected; key mismatches for hosts that
+// are already known still fail verification.
+func tofuCallback(path string, inner ssh.HostKeyCallback) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := inner(hostname, remote, key)
+		if err == nil {
+			return nil
+		}
+
+		var keyErr *knownhosts.KeyError
+		if !stderrors.As(err, &keyErr) || len(keyErr.Want) > 0 {
+			return err
+		}
+
+		return appendKnownHost(path, hostname, key)
+	}
+}
+
+// hostKeyCallback builds the ssh.HostKeyCallback for every SSH subcommand
+// (via buildClientConfig) according to the --known-hosts, --insecure and
+// --tofu flags.
+func hostKeyCallback(ctx *cli.Context) (ssh.HostKeyCallback, error) {
+	if ctx.Bool("insecure") {
+		return ssh.InsecureIgnoreHostKey(), nil
+	}
+
+	path := ctx.String("known-hosts")
+
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		// A missing known_hosts file just means an empty host-key database,
+		// not an error; knownhosts.New requires the file to already exist.
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			return nil, errors.Wrap(err, "creating known_hosts file")
+		}
+		f.Close()
+	}
+
+	cb, err := knownhosts.New(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "loading known_hosts file")
+	}
+
+	if ctx.Bool("tofu") {
+		cb = tofuCallback(path, cb)
+	}
+
+	return cb, nil
+}
+
 func prefixCopy(host string, w io.Writer, r io.Reader) {
 	s := bufio.NewScanner(r)
 	s.Split(bufio.ScanLines)
@@ -132,7 +337,54 @@ func prefixCopy(host string, w io.Writer, r io.Reader) {
 	}
 }
 
-func runN(items []string, count uint, fun func(tid uint, item string) error) []error {
+// task is a unit of work dispatched to a pool worker. idx is the item's
+// original position in the input, used by callers (such as sshCommand) that
+// need to derive positional information like which host to use; it is -1
+// for items with no fixed position, as with streamed input.
+type task struct {
+	idx  int
+	item string
+}
+
+// runPool runs a bounded pool of jobs workers, each pulling tasks off of
+// tasks until it is closed, and calling fun for each one with the worker's
+// stable id. It blocks until tasks is closed and every dispatched task has
+// completed.
+func runPool(jobs uint, tasks <-chan task, fun func(tid uint, idx int, item string) error) []error {
+	if jobs == 0 {
+		jobs = 1
+	}
+
+	errChan := make(chan error)
+	var wg sync.WaitGroup
+
+	for tid := uint(0); tid < jobs; tid++ {
+		wg.Add(1)
+		go func(tid uint) {
+			defer wg.Done()
+			for t := range tasks {
+				errChan <- fun(tid, t.idx, t.item)
+			}
+		}(tid)
+	}
+
+	go func() {
+		wg.Wait()
+		close(errChan)
+	}()
+
+	var outerErrs []error
+
+	for err := range errChan {
+		if err != nil {
+			outerErrs = append(outerErrs, err)
+		}
+	}
+
+	return outerErrs
+}
+
+func runN(items []string, count, jobs uint, fun func(tid uint, idx int, item string) error) []error {
 	if uint(len(items)) > count {
 		count = uint(len(items))
 	} else {
@@ -141,22 +393,35 @@ func runN(items []string, count uint, fun func(tid uint, item string) error) []e
 		items = newItems
 	}
 
-	errChan := make(chan error, count)
+	if jobs == 0 || jobs > count {
+		jobs = count
+	}
+
+	tasks := make(chan task, count)
 	for i := uint(0); i < count; i++ {
-		go func(tid uint, item string) {
-			errChan <- fun(tid, item)
-		}(i, items[i])
+		tasks <- task{idx: int(i), item: items[i]}
 	}
+	close(tasks)
 
-	var outerErrs []error
+	return runPool(jobs, tasks, fun)
+}
 
-	for i := uint(0); i < count; i++ {
-		if err := <-errChan; err != nil {
-			outerErrs = append(outerErrs, err)
+// runStream feeds the pool from r line-by-line as lines arrive, rather than
+// reading the whole input up front, so an unbounded pipe can be processed
+// without buffering it in memory. Streamed items have no fixed position, so
+// idx is always -1.
+func runStream(r io.Reader, jobs uint, fun func(tid uint, idx int, item string) error) []error {
+	tasks := make(chan task)
+
+	go func() {
+		defer close(tasks)
+		s := bufio.NewScanner(r)
+		for s.Scan() {
+			tasks <- task{idx: -1, item: strings.TrimSpace(s.Text())}
 		}
-	}
+	}()
 
-	return outerErrs
+	return runPool(jobs, tasks, fun)
 }
 
 func processErrors(errs []error) error {
@@ -229,19 +494,9 @@ func execCommand(ctx *cli.Context) error {
 		return errors.New("must supply a command to run")
 	}
 
-	var input []string
-
-	if ctx.Bool("input") {
-		var err error
-		input, err = readLines(os.Stdin)
-		if err != nil {
-			return errors.Wrap(err, "reading input")
-		}
-	}
-
-	count := ctx.Uint("count")
+	jobs := ctx.Uint("jobs")
 
-	errs := runN(input, count, func(tid uint, item string) error {
+	run := func(tid uint, idx int, item string) error {
 		args := []string{}
 		for _, arg := range ctx.Args() {
 			args = append(args, format(arg, tid, item))
@@ -276,39 +531,47 @@ func execCommand(ctx *cli.Context) error {
 		}
 
 		return nil
-	})
+	}
 
-	return processErrors(errs)
-}
+	var errs []error
 
-func sshCommand(ctx *cli.Context) error {
-	if len(ctx.Args()) < 2 {
-		return errors.New("must supply a host list file and command to run")
+	if ctx.Bool("input") && ctx.Bool("stream") {
+		errs = runStream(os.Stdin, jobs, run)
+	} else {
+		var input []string
+
+		if ctx.Bool("input") {
+			var err error
+			input, err = readLines(os.Stdin)
+			if err != nil {
+				return errors.Wrap(err, "reading input")
+			}
+		}
+
+		errs = runN(input, ctx.Uint("count"), jobs, run)
 	}
 
-	listFile := ctx.Args()[0]
-	args := ctx.Args()[1:]
+	return processErrors(errs)
+}
 
+// loadHosts reads a newline-delimited host:port list from listFile.
+func loadHosts(listFile string) ([]string, error) {
 	f, err := os.Open(listFile)
 	if err != nil {
-		return errors.Wrap(err, "could not open host list file")
+		return nil, errors.Wrap(err, "could not open host list file")
 	}
 
 	hosts, err := readLines(f)
 	if err != nil {
-		return errors.Wrap(err, "reading hosts")
+		return nil, errors.Wrap(err, "reading hosts")
 	}
 
-	var input []string
-
-	if ctx.Bool("input") {
-		var err error
-		input, err = readLines(os.Stdin)
-		if err != nil {
-			return errors.Wrap(err, "reading input")
-		}
-	}
+	return hosts, nil
+}
 
+// buildClientConfig assembles the ssh.ClientConfig shared by every
+// subcommand that dials out over SSH, from the sshConnFlags on ctx.
+func buildClientConfig(ctx *cli.Context) (*ssh.ClientConfig, error) {
 	auths := []ssh.AuthMethod{}
 
 	if ctx.String("password") != "" {
@@ -318,12 +581,12 @@ func sshCommand(ctx *cli.Context) error {
 	if ctx.String("identity") != "" {
 		key, err := ioutil.ReadFile(ctx.String("identity"))
 		if err != nil {
-			return errors.Wrap(err, "unable to read private key")
+			return nil, errors.Wrap(err, "unable to read private key")
 		}
 
 		signer, err := ssh.ParsePrivateKey(key)
 		if err != nil {
-			return errors.Wrap(err, "unable to parse private key")
+			return nil, errors.Wrap(err, "unable to parse private key")
 		}
 
 		auths = append(auths, ssh.PublicKeys(signer))
@@ -332,35 +595,492 @@ func sshCommand(ctx *cli.Context) error {
 	if len(auths) == 0 || (os.Getenv("SSH_AUTH_SOCK") != "" && !ctx.Bool("no-agent")) {
 		conn, err := net.Dial("unix", os.Getenv("SSH_AUTH_SOCK"))
 		if err != nil {
-			return errors.Wrap(err, "connecting to ssh agent")
+			return nil, errors.Wrap(err, "connecting to ssh agent")
 		}
 
 		signers, err := agent.NewClient(conn).Signers()
 		if err != nil {
-			return errors.Wrap(err, "reading agent keys")
+			return nil, errors.Wrap(err, "reading agent keys")
 		}
 
 		auths = append(auths, ssh.PublicKeys(signers...))
 	}
 
-	cc := &ssh.ClientConfig{
-		User: ctx.String("username"),
-		// FIXME I'm too lazy to fix this and I don't really need it. -erikh
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	hostKeyCB, err := hostKeyCallback(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ssh.ClientConfig{
+		User:            ctx.String("username"),
+		HostKeyCallback: hostKeyCB,
 		Auth:            auths,
 		Timeout:         ctx.Duration("timeout"),
+	}, nil
+}
+
+// outputRecord is one line of the --output json/ndjson stream: either a
+// stdout/stderr line record (Stream/Line/Ts set) or a terminal per-session
+// record (ExitCode/Duration set, Stream empty).
+type outputRecord struct {
+	Host     string `json:"host"`
+	TID      uint   `json:"tid"`
+	Stream   string `json:"stream,omitempty"`
+	Line     string `json:"line,omitempty"`
+	Ts       string `json:"ts,omitempty"`
+	ExitCode *int   `json:"exit_code,omitempty"`
+	Duration string `json:"duration,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// structuredWriter emits outputRecords as NDJSON to w, guarded by a mutex so
+// concurrent sessions don't interleave mid-record.
+type structuredWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (sw *structuredWriter) write(rec outputRecord) {
+	buf, err := json.Marshal(rec)
+	if err != nil {
+		return
+	}
+
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	fmt.Fprintln(sw.w, string(buf))
+}
+
+func (sw *structuredWriter) streamLines(host string, tid uint, stream string, r io.Reader) {
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		sw.write(outputRecord{Host: host, TID: tid, Stream: stream, Line: s.Text(), Ts: time.Now().Format(time.RFC3339Nano)})
+	}
+}
+
+// remoteExitCode extracts the remote command's exit code from the error
+// returned by session.Wait, or -1 if it didn't terminate normally.
+func remoteExitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+
+	var exitErr *ssh.ExitError
+	if stderrors.As(err, &exitErr) {
+		return exitErr.ExitStatus()
+	}
+
+	return -1
+}
+
+// bumpMax atomically sets *addr to val if val is larger than its current
+// value.
+func bumpMax(addr *int64, val int64) {
+	for {
+		cur := atomic.LoadInt64(addr)
+		if val <= cur {
+			return
+		}
+		if atomic.CompareAndSwapInt64(addr, cur, val) {
+			return
+		}
+	}
+}
+
+func sshCommand(ctx *cli.Context) error {
+	if len(ctx.Args()) < 2 {
+		return errors.New("must supply a host list file and command to run")
+	}
+
+	output := ctx.String("output")
+	switch output {
+	case "", "text", "json", "ndjson":
+	default:
+		return errors.Errorf("unknown --output mode %q", output)
+	}
+
+	structured := output == "json" || output == "ndjson"
+
+	listFile := ctx.Args()[0]
+	args := ctx.Args()[1:]
+
+	hosts, err := loadHosts(listFile)
+	if err != nil {
+		return err
+	}
+
+	if len(hosts) == 0 {
+		return errors.New("host list is empty")
+	}
+
+	cc, err := buildClientConfig(ctx)
+	if err != nil {
+		return err
 	}
 
 	count := ctx.Uint("count")
+	jobs := ctx.Uint("jobs")
+	retries := ctx.Uint("retries")
+	retryDelay := ctx.Duration("retry-delay")
+
+	sw := &structuredWriter{w: os.Stdout}
+	var maxExit int64
+
+	tty := ctx.Bool("tty")
+	single := tty && len(hosts) == 1 && count == 1 && !ctx.Bool("input")
+
+	if single && terminal.IsTerminal(int(os.Stdin.Fd())) {
+		state, err := terminal.MakeRaw(int(os.Stdin.Fd()))
+		if err != nil {
+			return errors.Wrap(err, "putting local tty into raw mode")
+		}
+		defer terminal.Restore(int(os.Stdin.Fd()), state)
+	}
+
+	var nextHost uint64
+
+	run := func(tid uint, idx int, item string) error {
+		// idx reflects the item's position for fixed-size runs, letting us
+		// reproduce "count invocations per host" in order; streamed items
+		// have no fixed position, so spread them across hosts round-robin.
+		var host string
+		if idx >= 0 {
+			host = hosts[uint(idx)/count]
+		} else {
+			host = hosts[atomic.AddUint64(&nextHost, 1)%uint64(len(hosts))]
+		}
+
+		if !strings.Contains(host, ":") {
+			host += ":22"
+		}
+
+		start := time.Now()
+
+		runErr := func() error {
+			client, err := dialWithRetry(host, cc, retries, retryDelay)
+			if err != nil {
+				return errors.Wrap(err, "unable to connect")
+			}
+			defer client.Close()
+
+			s, err := client.NewSession()
+			if err != nil {
+				return errors.Wrap(err, "establishing session")
+			}
+			defer s.Close()
+
+			var (
+				outPipe, errPipe io.Reader
+				doCopy           = !ctx.Bool("quiet")
+			)
+
+			if doCopy {
+				var err error
+
+				outPipe, err = s.StdoutPipe()
+				if err != nil {
+					return errors.Wrap(err, "connecting to stdout")
+				}
+
+				errPipe, err = s.StderrPipe()
+				if err != nil {
+					return errors.Wrap(err, "connecting to stderr")
+				}
+			}
+
+			var stdin io.WriteCloser
+
+			if tty {
+				w, h := 80, 24
+				if ww, hh, err := terminal.GetSize(int(os.Stdin.Fd())); err == nil {
+					w, h = ww, hh
+				}
+
+				termName := os.Getenv("TERM")
+				if termName == "" {
+					termName = "xterm"
+				}
+
+				modes := ssh.TerminalModes{
+					ssh.ECHO:          1,
+					ssh.TTY_OP_ISPEED: 14400,
+					ssh.TTY_OP_OSPEED: 14400,
+				}
+
+				if err := s.RequestPty(termName, h, w, modes); err != nil {
+					return errors.Wrapf(err, "allocating pty on %v", host)
+				}
+
+				if single || ctx.Bool("sudo") {
+					stdin, err = s.StdinPipe()
+					if err != nil {
+						return errors.Wrap(err, "connecting to stdin")
+					}
+				}
+
+				winch := make(chan os.Signal, 1)
+				signal.Notify(winch, syscall.SIGWINCH)
+				defer func() {
+					signal.Stop(winch)
+					close(winch)
+				}()
+
+				go func() {
+					for range winch {
+						if ww, hh, err := terminal.GetSize(int(os.Stdin.Fd())); err == nil {
+							s.SendRequest("window-change", false, ssh.Marshal(&winchMsg{uint32(ww), uint32(hh), 0, 0}))
+						}
+					}
+				}()
+			}
+
+			if err := s.Start(format(strings.Join(args, " "), tid, item)); err != nil {
+				return errors.Wrapf(err, "executing %v on %v", args, host)
+			}
+
+			if ctx.Bool("sudo") && stdin != nil {
+				if _, err := io.WriteString(stdin, ctx.String("password")+"\n"); err != nil {
+					return errors.Wrapf(err, "piping sudo password to %v", host)
+				}
+
+				if !single {
+					stdin.Close()
+				}
+			}
+
+			if single && stdin != nil {
+				go func() {
+					io.Copy(stdin, os.Stdin)
+					stdin.Close()
+				}()
+			}
+
+			if doCopy {
+				switch {
+				case structured:
+					go sw.streamLines(host, tid, "stderr", errPipe)
+					sw.streamLines(host, tid, "stdout", outPipe)
+				case ctx.Bool("no-prefix"):
+					go io.Copy(os.Stderr, errPipe)
+					io.Copy(os.Stdout, outPipe)
+				default:
+					go prefixCopy(host, os.Stderr, errPipe)
+					prefixCopy(host, os.Stdout, outPipe)
+				}
+			}
+
+			return s.Wait()
+		}()
+
+		if structured {
+			exitCode := remoteExitCode(runErr)
+			bumpMax(&maxExit, int64(exitCode))
+
+			rec := outputRecord{Host: host, TID: tid, ExitCode: &exitCode, Duration: time.Since(start).String()}
+			if runErr != nil {
+				rec.Error = runErr.Error()
+			}
+
+			sw.write(rec)
+		}
+
+		return runErr
+	}
+
+	var errs []error
+
+	if ctx.Bool("input") && ctx.Bool("stream") {
+		errs = runStream(os.Stdin, jobs, run)
+	} else {
+		var input []string
+
+		if ctx.Bool("input") {
+			var err error
+			input, err = readLines(os.Stdin)
+			if err != nil {
+				return errors.Wrap(err, "reading input")
+			}
+		}
+
+		errs = runN(input, count*uint(len(hosts)), jobs, run)
+	}
+
+	if structured {
+		if maxExit > 0 {
+			return cli.NewExitError(fmt.Sprintf("commands exited with max remote status %d", maxExit), int(maxExit))
+		}
+		if len(errs) > 0 {
+			return cli.NewExitError("some commands had errors", 1)
+		}
+		return nil
+	}
+
+	return processErrors(errs)
+}
+
+// winchMsg is the RFC 4254 section 6.7 window-change request payload.
+type winchMsg struct {
+	Width, Height           uint32
+	PixelWidth, PixelHeight uint32
+}
 
-	errs := runN(input, count*uint(len(hosts)), func(tid uint, item string) error {
-		// Connect to the remote server and perform the SSH handshake.
-		host := hosts[tid/count]
+// dialWithRetry dials host, retrying up to retries times with delay between
+// attempts if the dial itself fails; this keeps a transient network blip
+// from killing an otherwise healthy run.
+func dialWithRetry(host string, cc *ssh.ClientConfig, retries uint, delay time.Duration) (*ssh.Client, error) {
+	var (
+		client *ssh.Client
+		err    error
+	)
+
+	for attempt := uint(0); attempt <= retries; attempt++ {
+		client, err = ssh.Dial("tcp", host, cc)
+		if err == nil {
+			return client, nil
+		}
+
+		if attempt < retries {
+			time.Sleep(delay)
+		}
+	}
+
+	return nil, err
+}
+
+// scriptStep is a single send/expect step of an ssh-script.
+type scriptStep struct {
+	Send    string `yaml:"send" json:"send"`
+	Expect  string `yaml:"expect" json:"expect"`
+	Timeout string `yaml:"timeout" json:"timeout"`
+}
+
+// loadScript reads an ordered list of scriptSteps from a YAML or JSON file,
+// chosen by the .json extension.
+func loadScript(path string) ([]scriptStep, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading script file")
+	}
+
+	var steps []scriptStep
+
+	if strings.HasSuffix(path, ".json") {
+		if err := json.Unmarshal(buf, &steps); err != nil {
+			return nil, errors.Wrap(err, "parsing JSON script")
+		}
+	} else if err := yaml.Unmarshal(buf, &steps); err != nil {
+		return nil, errors.Wrap(err, "parsing YAML script")
+	}
+
+	return steps, nil
+}
+
+// driveScript writes each step's send string to stdin, and for steps with an
+// expect regex, blocks until a line matching it is read from stdout or the
+// step's timeout elapses. Every line read from stdout is written to out,
+// prefixed with host unless prefix is false.
+func driveScript(host string, stdin io.WriteCloser, stdout io.Reader, out io.Writer, prefix bool, steps []scriptStep) error {
+	lines := make(chan string)
+
+	go func() {
+		defer close(lines)
+		s := bufio.NewScanner(stdout)
+		for s.Scan() {
+			text := s.Text()
+			if prefix {
+				fmt.Fprintf(out, "[%v] %s\n", host, text)
+			} else {
+				fmt.Fprintln(out, text)
+			}
+			lines <- text
+		}
+	}()
+
+	// Keep consuming stdout once the steps are done (or one fails), so the
+	// rest of the shell's output is still written to out.
+	defer func() {
+		go func() {
+			for range lines {
+			}
+		}()
+	}()
+
+	for i, step := range steps {
+		if step.Send != "" {
+			if _, err := io.WriteString(stdin, step.Send); err != nil {
+				return errors.Wrapf(err, "sending step %d", i)
+			}
+		}
+
+		if step.Expect == "" {
+			continue
+		}
+
+		re, err := regexp.Compile(step.Expect)
+		if err != nil {
+			return errors.Wrapf(err, "compiling expect regex for step %d", i)
+		}
+
+		timeout := time.Minute
+		if step.Timeout != "" {
+			timeout, err = time.ParseDuration(step.Timeout)
+			if err != nil {
+				return errors.Wrapf(err, "parsing timeout for step %d", i)
+			}
+		}
+
+		deadline := time.After(timeout)
+
+		for matched := false; !matched; {
+			select {
+			case text, ok := <-lines:
+				if !ok {
+					return errors.Errorf("step %d: session closed before %q was seen", i, step.Expect)
+				}
+				matched = re.MatchString(text)
+			case <-deadline:
+				return errors.Errorf("step %d: timed out waiting for %q", i, step.Expect)
+			}
+		}
+	}
+
+	return stdin.Close()
+}
+
+func sshScriptCommand(ctx *cli.Context) error {
+	if len(ctx.Args()) < 2 {
+		return errors.New("must supply a host list file and a script file")
+	}
+
+	hosts, err := loadHosts(ctx.Args()[0])
+	if err != nil {
+		return err
+	}
+
+	steps, err := loadScript(ctx.Args()[1])
+	if err != nil {
+		return err
+	}
+
+	cc, err := buildClientConfig(ctx)
+	if err != nil {
+		return err
+	}
+
+	count := ctx.Uint("count")
+	jobs := ctx.Uint("jobs")
+	retries := ctx.Uint("retries")
+	retryDelay := ctx.Duration("retry-delay")
+	prefix := !ctx.Bool("no-prefix")
+	quiet := ctx.Bool("quiet")
+
+	run := func(tid uint, idx int, item string) error {
+		host := hosts[uint(idx)/count]
 		if !strings.Contains(host, ":") {
 			host += ":22"
 		}
 
-		client, err := ssh.Dial("tcp", host, cc)
+		client, err := dialWithRetry(host, cc, retries, retryDelay)
 		if err != nil {
 			return errors.Wrap(err, "unable to connect")
 		}
@@ -372,41 +1092,304 @@ func sshCommand(ctx *cli.Context) error {
 		}
 		defer s.Close()
 
-		var (
-			outPipe, errPipe io.Reader
-			doCopy           = !ctx.Bool("quiet")
-		)
+		stdin, err := s.StdinPipe()
+		if err != nil {
+			return errors.Wrap(err, "connecting to stdin")
+		}
 
-		if doCopy {
-			var err error
+		stdout, err := s.StdoutPipe()
+		if err != nil {
+			return errors.Wrap(err, "connecting to stdout")
+		}
 
-			outPipe, err = s.StdoutPipe()
-			if err != nil {
-				return errors.Wrap(err, "connecting to stdout")
-			}
+		errPipe, err := s.StderrPipe()
+		if err != nil {
+			return errors.Wrap(err, "connecting to stderr")
+		}
 
-			errPipe, err = s.StderrPipe()
-			if err != nil {
-				return errors.Wrap(err, "connecting to stderr")
-			}
+		out := io.Writer(os.Stdout)
+		errOut := io.Writer(os.Stderr)
+		if quiet {
+			out = ioutil.Discard
+			errOut = ioutil.Discard
 		}
 
-		if err := s.Start(format(strings.Join(args, " "), tid, item)); err != nil {
-			return errors.Wrapf(err, "executing %v on %v", args, host)
+		if prefix {
+			go prefixCopy(host, errOut, errPipe)
+		} else {
+			go io.Copy(errOut, errPipe)
 		}
 
-		if doCopy {
-			if ctx.Bool("no-prefix") {
-				go io.Copy(os.Stderr, errPipe)
-				io.Copy(os.Stdout, outPipe)
-			} else {
-				go prefixCopy(host, os.Stderr, errPipe)
-				prefixCopy(host, os.Stdout, outPipe)
-			}
+		if err := s.Shell(); err != nil {
+			return errors.Wrapf(err, "starting shell on %v", host)
+		}
+
+		if err := driveScript(host, stdin, stdout, out, prefix, steps); err != nil {
+			return errors.Wrapf(err, "running script on %v", host)
 		}
 
 		return s.Wait()
+	}
+
+	items := make([]string, uint(len(hosts))*count)
+	errs := runN(items, uint(len(items)), jobs, run)
+
+	return processErrors(errs)
+}
+
+// newSFTPClient opens an SFTP subsystem session on client and wraps it in an
+// *sftp.Client. The returned session must be closed by the caller once the
+// sftp.Client is done with it.
+func newSFTPClient(client *ssh.Client) (*sftp.Client, *ssh.Session, error) {
+	s, err := client.NewSession()
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "establishing session")
+	}
+
+	stdin, err := s.StdinPipe()
+	if err != nil {
+		s.Close()
+		return nil, nil, errors.Wrap(err, "connecting to stdin")
+	}
+
+	stdout, err := s.StdoutPipe()
+	if err != nil {
+		s.Close()
+		return nil, nil, errors.Wrap(err, "connecting to stdout")
+	}
+
+	if err := s.RequestSubsystem("sftp"); err != nil {
+		s.Close()
+		return nil, nil, errors.Wrap(err, "requesting sftp subsystem")
+	}
+
+	sc, err := sftp.NewClientPipe(stdout, stdin)
+	if err != nil {
+		s.Close()
+		return nil, nil, errors.Wrap(err, "starting sftp client")
+	}
+
+	return sc, s, nil
+}
+
+var progressMu sync.Mutex
+
+// reportProgress prints a single-line per-host transfer record to stdout,
+// guarded by a mutex so concurrent workers don't interleave mid-line.
+func reportProgress(host, src, dst string, n int64, prefix bool) {
+	progressMu.Lock()
+	defer progressMu.Unlock()
+
+	if prefix {
+		fmt.Printf("[%v] %s -> %s (%d bytes)\n", host, src, dst, n)
+	} else {
+		fmt.Printf("%s -> %s (%d bytes)\n", src, dst, n)
+	}
+}
+
+// forEachHost runs fun once per host, over a pool of jobs workers, dialing
+// and establishing an SFTP client for each connection.
+func forEachHost(hosts []string, cc *ssh.ClientConfig, jobs, retries uint, retryDelay time.Duration, fun func(host string, sc *sftp.Client) error) []error {
+	items := make([]string, len(hosts))
+
+	return runN(items, uint(len(items)), jobs, func(tid uint, idx int, item string) error {
+		rawHost := hosts[idx]
+		host := rawHost
+		if !strings.Contains(host, ":") {
+			host += ":22"
+		}
+
+		client, err := dialWithRetry(host, cc, retries, retryDelay)
+		if err != nil {
+			return errors.Wrap(err, "unable to connect")
+		}
+		defer client.Close()
+
+		sc, s, err := newSFTPClient(client)
+		if err != nil {
+			return err
+		}
+		defer s.Close()
+		defer sc.Close()
+
+		return fun(rawHost, sc)
+	})
+}
+
+func pushCommand(ctx *cli.Context) error {
+	if len(ctx.Args()) < 3 {
+		return errors.New("must supply a host list file, a local path, and a remote path")
+	}
+
+	hosts, err := loadHosts(ctx.Args()[0])
+	if err != nil {
+		return err
+	}
+
+	localPath := ctx.Args()[1]
+	remotePath := ctx.Args()[2]
+
+	cc, err := buildClientConfig(ctx)
+	if err != nil {
+		return err
+	}
+
+	prefix := !ctx.Bool("no-prefix")
+
+	errs := forEachHost(hosts, cc, ctx.Uint("jobs"), ctx.Uint("retries"), ctx.Duration("retry-delay"), func(host string, sc *sftp.Client) error {
+		return pushPath(sc, host, localPath, remotePath, prefix)
 	})
 
 	return processErrors(errs)
 }
+
+// pushPath copies localPath to remotePath over sc, recursing into
+// subdirectories when localPath is a directory.
+func pushPath(sc *sftp.Client, host, localPath, remotePath string, prefix bool) error {
+	info, err := os.Stat(localPath)
+	if err != nil {
+		return errors.Wrap(err, "stat local path")
+	}
+
+	if !info.IsDir() {
+		return pushFile(sc, host, localPath, remotePath, prefix)
+	}
+
+	return filepath.Walk(localPath, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(localPath, p)
+		if err != nil {
+			return err
+		}
+
+		remote := path.Join(remotePath, filepath.ToSlash(rel))
+
+		if fi.IsDir() {
+			return sc.MkdirAll(remote)
+		}
+
+		return pushFile(sc, host, p, remote, prefix)
+	})
+}
+
+func pushFile(sc *sftp.Client, host, localPath, remotePath string, prefix bool) error {
+	src, err := os.Open(localPath)
+	if err != nil {
+		return errors.Wrap(err, "opening local file")
+	}
+	defer src.Close()
+
+	if err := sc.MkdirAll(path.Dir(remotePath)); err != nil {
+		return errors.Wrap(err, "creating remote directory")
+	}
+
+	dst, err := sc.Create(remotePath)
+	if err != nil {
+		return errors.Wrap(err, "creating remote file")
+	}
+	defer dst.Close()
+
+	n, err := io.Copy(dst, src)
+	if err != nil {
+		return errors.Wrap(err, "copying file")
+	}
+
+	reportProgress(host, localPath, remotePath, n, prefix)
+	return nil
+}
+
+func pullCommand(ctx *cli.Context) error {
+	if len(ctx.Args()) < 3 {
+		return errors.New("must supply a host list file, a remote path, and a local directory")
+	}
+
+	hosts, err := loadHosts(ctx.Args()[0])
+	if err != nil {
+		return err
+	}
+
+	remotePath := ctx.Args()[1]
+	localDir := ctx.Args()[2]
+
+	cc, err := buildClientConfig(ctx)
+	if err != nil {
+		return err
+	}
+
+	prefix := !ctx.Bool("no-prefix")
+
+	errs := forEachHost(hosts, cc, ctx.Uint("jobs"), ctx.Uint("retries"), ctx.Duration("retry-delay"), func(host string, sc *sftp.Client) error {
+		return pullPath(sc, host, remotePath, filepath.Join(localDir, host), prefix)
+	})
+
+	return processErrors(errs)
+}
+
+// pullPath copies remotePath into localDir over sc, recursing into
+// subdirectories when remotePath is a directory.
+func pullPath(sc *sftp.Client, host, remotePath, localDir string, prefix bool) error {
+	info, err := sc.Stat(remotePath)
+	if err != nil {
+		return errors.Wrap(err, "stat remote path")
+	}
+
+	if !info.IsDir() {
+		return pullFile(sc, host, remotePath, filepath.Join(localDir, path.Base(remotePath)), prefix)
+	}
+
+	walker := sc.Walk(remotePath)
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(remotePath, walker.Path())
+		if err != nil {
+			return err
+		}
+
+		local := filepath.Join(localDir, rel)
+
+		if walker.Stat().IsDir() {
+			if err := os.MkdirAll(local, 0755); err != nil {
+				return errors.Wrap(err, "creating local directory")
+			}
+			continue
+		}
+
+		if err := pullFile(sc, host, walker.Path(), local, prefix); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func pullFile(sc *sftp.Client, host, remotePath, localPath string, prefix bool) error {
+	if err := os.MkdirAll(filepath.Dir(localPath), 0755); err != nil {
+		return errors.Wrap(err, "creating local directory")
+	}
+
+	src, err := sc.Open(remotePath)
+	if err != nil {
+		return errors.Wrap(err, "opening remote file")
+	}
+	defer src.Close()
+
+	dst, err := os.Create(localPath)
+	if err != nil {
+		return errors.Wrap(err, "creating local file")
+	}
+	defer dst.Close()
+
+	n, err := io.Copy(dst, src)
+	if err != nil {
+		return errors.Wrap(err, "copying file")
+	}
+
+	reportProgress(host, remotePath, localPath, n, prefix)
+	return nil
+}